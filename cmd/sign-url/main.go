@@ -0,0 +1,73 @@
+// Command sign-url mints signed query parameters for the img-optimizer
+// server's `-signing-key`/`-signing-salt` scheme, so upstream apps can
+// generate links at render time without reimplementing the HMAC.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/ryicoh/img-optimizer/internal/sign"
+)
+
+func main() {
+	var (
+		signingKeyHex  string
+		signingSaltHex string
+		imageURL       string
+		width          string
+		height         string
+		quality        string
+		base           string
+	)
+
+	flag.StringVar(&signingKeyHex, "signing-key", "", "Hex-encoded signing key, must match the server's -signing-key")
+	flag.StringVar(&signingSaltHex, "signing-salt", "", "Hex-encoded signing salt, must match the server's -signing-salt")
+	flag.StringVar(&imageURL, "url", "", "Path of the source image, as passed to the `url` query param")
+	flag.StringVar(&width, "w", "0", "Target width")
+	flag.StringVar(&height, "h", "0", "Target height")
+	flag.StringVar(&quality, "q", "", "Target quality")
+	flag.StringVar(&base, "base", "", "Optional base URL of the img-optimizer server to print a full link")
+	flag.Parse()
+
+	if imageURL == "" {
+		fmt.Fprintln(os.Stderr, "flag `-url` is required")
+		os.Exit(1)
+	}
+
+	key, err := hex.DecodeString(signingKeyHex)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -signing-key: %+v\n", err)
+		os.Exit(1)
+	}
+
+	salt, err := hex.DecodeString(signingSaltHex)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -signing-salt: %+v\n", err)
+		os.Exit(1)
+	}
+
+	sig := sign.Compute(key, salt, imageURL, width, height, quality)
+
+	q := url.Values{}
+	q.Set("url", imageURL)
+	if width != "0" {
+		q.Set("w", width)
+	}
+	if height != "0" {
+		q.Set("h", height)
+	}
+	if quality != "" {
+		q.Set("q", quality)
+	}
+	q.Set("sig", sig)
+
+	if base != "" {
+		fmt.Println(base + "?" + q.Encode())
+	} else {
+		fmt.Println(q.Encode())
+	}
+}
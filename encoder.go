@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/chai2010/webp"
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+)
+
+// Encoder produces a WebP image at dstPath from the original at srcPath,
+// honoring the w/h/q query params (width or height 0 preserves aspect
+// ratio against the other), and returns its sha256 hex digest so callers
+// don't need a second pass over the file to compute an ETag.
+type Encoder interface {
+	EncodeWebp(ctx context.Context, srcPath, dstPath string, width, height, quality int) (string, error)
+}
+
+// cwebpEncoder shells out to the `cwebp` binary, as the server always has.
+type cwebpEncoder struct{}
+
+func (cwebpEncoder) EncodeWebp(ctx context.Context, srcPath, dstPath string, width, height, quality int) (string, error) {
+	if out, err := exec.CommandContext(ctx, "cwebp", "-quiet", "-q", strconv.Itoa(quality), "-resize", strconv.Itoa(width), strconv.Itoa(height), srcPath, "-o", dstPath).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to execute cwebp (%s): %w", out, err)
+	}
+
+	return hashFile(dstPath)
+}
+
+// nativeEncoder decodes, resizes and encodes entirely in-process via
+// github.com/chai2010/webp, so it has no subprocess to time out and no
+// intermediate file between decode and encode.
+type nativeEncoder struct{}
+
+func (nativeEncoder) EncodeWebp(ctx context.Context, srcPath, dstPath string, width, height, quality int) (string, error) {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode %s: %w", srcPath, err)
+	}
+
+	dst, err := os.OpenFile(dstPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+
+	h := sha256.New()
+	if err := webp.Encode(io.MultiWriter(dst, h), resize(img, width, height), &webp.Options{Quality: float32(quality)}); err != nil {
+		return "", fmt.Errorf("failed to encode webp: %w", err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// resize scales img to width x height, filling in whichever dimension is 0
+// from the other to preserve aspect ratio. Downscaling uses Catmull-Rom for
+// sharper results; upscaling uses the cheaper ApproxBiLinear.
+func resize(img image.Image, width, height int) image.Image {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+
+	if width == 0 && height == 0 {
+		return img
+	}
+	if width == 0 {
+		width = sw * height / sh
+	}
+	if height == 0 {
+		height = sh * width / sw
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	scaler := draw.ApproxBiLinear
+	if width < sw && height < sh {
+		scaler = draw.CatmullRom
+	}
+
+	scaler.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+
+	return dst
+}
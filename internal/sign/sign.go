@@ -0,0 +1,33 @@
+// Package sign implements the imgproxy-style HMAC signature used to
+// authorize transform requests, shared by the server and the
+// cmd/sign-url helper so both agree on the same canonical form.
+package sign
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// Compute returns the URL-safe base64 signature over the canonicalized
+// `url|w|h|q` tuple, salted and keyed with key/salt.
+func Compute(key, salt []byte, urlQ, width, height, quality string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	mac.Write([]byte(urlQ))
+	mac.Write([]byte{'|'})
+	mac.Write([]byte(width))
+	mac.Write([]byte{'|'})
+	mac.Write([]byte(height))
+	mac.Write([]byte{'|'})
+	mac.Write([]byte(quality))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether sig matches the signature computed for the same
+// tuple, in constant time.
+func Verify(key, salt []byte, sig, urlQ, width, height, quality string) bool {
+	expected := Compute(key, salt, urlQ, width, height, quality)
+	return hmac.Equal([]byte(expected), []byte(sig))
+}
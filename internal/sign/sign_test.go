@@ -0,0 +1,50 @@
+package sign
+
+import "testing"
+
+func TestVerifyRoundTrip(t *testing.T) {
+	key := []byte("key")
+	salt := []byte("salt")
+
+	sig := Compute(key, salt, "/foo.jpg", "100", "0", "80")
+
+	if !Verify(key, salt, sig, "/foo.jpg", "100", "0", "80") {
+		t.Fatal("Verify rejected a signature Compute just produced")
+	}
+}
+
+func TestVerifyRejectsTamperedInputs(t *testing.T) {
+	key := []byte("key")
+	salt := []byte("salt")
+
+	sig := Compute(key, salt, "/foo.jpg", "100", "0", "80")
+
+	cases := []struct {
+		name                      string
+		urlQ, width, height, qual string
+	}{
+		{"different url", "/bar.jpg", "100", "0", "80"},
+		{"different width", "/foo.jpg", "200", "0", "80"},
+		{"different height", "/foo.jpg", "100", "50", "80"},
+		{"different quality", "/foo.jpg", "100", "0", "60"},
+		{"empty height not same as zero", "/foo.jpg", "100", "", "80"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if Verify(key, salt, sig, c.urlQ, c.width, c.height, c.qual) {
+				t.Errorf("Verify accepted a tuple that doesn't match what was signed")
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsWrongKeyOrSalt(t *testing.T) {
+	sig := Compute([]byte("key"), []byte("salt"), "/foo.jpg", "0", "0", "")
+
+	if Verify([]byte("wrong"), []byte("salt"), sig, "/foo.jpg", "0", "0", "") {
+		t.Error("Verify accepted a signature with the wrong key")
+	}
+	if Verify([]byte("key"), []byte("wrong"), sig, "/foo.jpg", "0", "0", "") {
+		t.Error("Verify accepted a signature with the wrong salt")
+	}
+}
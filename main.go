@@ -3,30 +3,48 @@ package main
 import (
 	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
+	"image"
+	"image/png"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
+
+	"github.com/ryicoh/img-optimizer/internal/sign"
 )
 
 var (
-	port        = 8098
-	cacheDir    = ""
-	cacheSize   = 128
-	originalURL string
+	port           = 8098
+	cacheDir       = ""
+	cacheSize      = 128
+	cacheMaxAge    int64 = -1
+	originalURL    string
+	formatsFlag    = "avif,webp"
+	clientMaxAge   int64 = 3600
+	negativeTTL    int64 = 60
+	encoderFlag    = "cwebp"
+	signingKeyHex  string
+	signingSaltHex string
 
 	allowedOrigins []string
+	enabledFormats map[string]bool
+	encoderBackend Encoder
+	signingKey     []byte
+	signingSalt    []byte
 
 	errEmptyCacheDirFlag = errors.New("flag `-cache-dir` is empty")
 	errEmptyOriginalFlag = errors.New("flag `-original-url` is empty")
@@ -36,11 +54,28 @@ var (
 	erro = log.New(os.Stderr, "[ERRO] ", log.LstdFlags)
 )
 
+// format is a cacheable output encoding. formatOriginal means the origin
+// bytes are served untouched.
+type format string
+
+const (
+	formatAVIF     format = "avif"
+	formatWebp     format = "webp"
+	formatOriginal format = "orig"
+)
+
 func parseFlags() error {
 	flag.IntVar(&port, "port", port, fmt.Sprintf("Server port (default:%d)", port))
 	flag.StringVar(&cacheDir, "cache-dir", cacheDir, "Directory for cache")
 	flag.IntVar(&cacheSize, "cache-size", cacheSize, "Number of image to cache")
+	flag.Int64Var(&cacheMaxAge, "cache-max-age", cacheMaxAge, "Max age in seconds of a cache entry (-1=forever, 0=disabled)")
 	flag.StringVar(&originalURL, "original-url", originalURL, "URL of original image")
+	flag.StringVar(&formatsFlag, "formats", formatsFlag, "Comma separated list of enabled encodings (avif,webp)")
+	flag.Int64Var(&clientMaxAge, "client-max-age", clientMaxAge, "Value of Cache-Control max-age sent to clients, in seconds")
+	flag.Int64Var(&negativeTTL, "negative-ttl", negativeTTL, "Seconds to avoid retrying a URL after a failed upstream fetch (0=disabled)")
+	flag.StringVar(&encoderFlag, "encoder", encoderFlag, "WebP encoder backend: cwebp|native")
+	flag.StringVar(&signingKeyHex, "signing-key", signingKeyHex, "Hex-encoded HMAC key; when empty, requests are not required to be signed")
+	flag.StringVar(&signingSaltHex, "signing-salt", signingSaltHex, "Hex-encoded HMAC salt")
 
 	cors := ""
 	flag.StringVar(&cors, "cors", cors, "List of domains for CORS")
@@ -48,6 +83,36 @@ func parseFlags() error {
 
 	allowedOrigins = strings.Split(cors, ",")
 
+	enabledFormats = map[string]bool{}
+	for _, f := range strings.Split(formatsFlag, ",") {
+		f = strings.TrimSpace(f)
+		if f != "" {
+			enabledFormats[f] = true
+		}
+	}
+
+	switch encoderFlag {
+	case "native":
+		encoderBackend = nativeEncoder{}
+	default:
+		encoderBackend = cwebpEncoder{}
+	}
+
+	if signingKeyHex != "" {
+		key, err := hex.DecodeString(signingKeyHex)
+		if err != nil {
+			return fmt.Errorf("invalid -signing-key: %w", err)
+		}
+
+		salt, err := hex.DecodeString(signingSaltHex)
+		if err != nil {
+			return fmt.Errorf("invalid -signing-salt: %w", err)
+		}
+
+		signingKey = key
+		signingSalt = salt
+	}
+
 	if cacheDir == "" {
 		return errEmptyCacheDirFlag
 	}
@@ -59,6 +124,16 @@ func parseFlags() error {
 	return nil
 }
 
+func maxAgeFromFlag(seconds int64) time.Duration {
+	if seconds < 0 {
+		return cacheForever
+	}
+	if seconds == 0 {
+		return cacheDisabled
+	}
+	return time.Duration(seconds) * time.Second
+}
+
 func main() {
 	if err := run(); err != nil {
 		os.Stderr.WriteString(fmt.Sprintf("%+v\n", err))
@@ -76,13 +151,19 @@ func run() error {
 	}
 
 	client := &http.Client{Timeout: 3 * time.Second}
-	cache := newStore(cacheDir)
+	cache := newStoreWithConfig(cacheConfig{
+		dir:         cacheDir,
+		maxAge:      maxAgeFromFlag(cacheMaxAge),
+		maxItems:    cacheSize,
+		negativeTTL: time.Duration(negativeTTL) * time.Second,
+	})
 	originalURL, err := url.Parse(originalURL)
 	if err != nil {
 		return err
 	}
 
 	http.HandleFunc("/", handler(client, cache, originalURL))
+	http.HandleFunc("/metrics", metricsHandler(cache))
 	srv := &http.Server{Addr: fmt.Sprintf(":%d", port)}
 
 	info.Printf("listened on :%d", port)
@@ -117,22 +198,41 @@ func run() error {
 	return nil
 }
 
+// negotiateFormat picks the best encoding for a client's `Accept` header,
+// preferring AVIF over WebP over the original bytes, restricted to
+// whatever `-formats` enabled.
+func negotiateFormat(accept string) format {
+	if enabledFormats["avif"] && strings.Contains(accept, "image/avif") {
+		return formatAVIF
+	}
+
+	if enabledFormats["webp"] && strings.Contains(accept, "image/webp") {
+		return formatWebp
+	}
+
+	return formatOriginal
+}
+
+func contentTypeFor(f format, urlQ string) string {
+	switch f {
+	case formatAVIF:
+		return "image/avif"
+	case formatWebp:
+		return "image/webp"
+	default:
+		if ct := mime.TypeByExtension(filepath.Ext(urlQ)); ct != "" {
+			return ct
+		}
+		return "application/octet-stream"
+	}
+}
+
 func handler(client *http.Client, cache *store, originalURL *url.URL) func(rw http.ResponseWriter, r *http.Request) {
 	return func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Add("Vary", "Accept")
+
 		hash := sha1.Sum([]byte(r.URL.Path + r.URL.RawQuery))
 		filename := hex.EncodeToString((hash[:]))
-		webpPath := filepath.Join(cacheDir,filename + ".webp")
-
-		if r, err := cache.get(webpPath); err == nil {
-			defer r.Close()
-
-			if err := writeWebp(rw, r); err != nil {
-				warn.Printf("%+v", err)
-			} else {
-				return
-			
-			}
-		}
 
 		query := r.URL.Query()
 		urlQ := query.Get("url")
@@ -149,68 +249,207 @@ func handler(client *http.Client, cache *store, originalURL *url.URL) func(rw ht
 		if height == "" {
 			height = "0"
 		}
-
 		quality := query.Get("q")
 
-		fullURL := (&url.URL{
-			Scheme: originalURL.Scheme,
-			Host:   originalURL.Host,
-			Path:   urlQ,
-		}).String()
-
-		res, err := client.Get(fullURL)
-		if err != nil {
-			erro.Printf("%+v", err)
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
+		if len(signingKey) > 0 && !sign.Verify(signingKey, signingSalt, query.Get("sig"), urlQ, width, height, quality) {
+			http.Error(rw, "invalid or missing `sig`", http.StatusForbidden)
 			return
 		}
-		defer res.Body.Close()
 
-		origPath := filepath.Join(cacheDir, filename + filepath.Ext(urlQ))
-		origFile, err := os.OpenFile(origPath, os.O_RDWR|os.O_CREATE, 0644)
-		if err != nil {
-			erro.Printf("%+v", err)
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer origFile.Close()
+		outFormat := negotiateFormat(r.Header.Get("Accept"))
+		contentType := contentTypeFor(outFormat, urlQ)
+		cachePath := filepath.Join(cacheDir, filename+"."+string(outFormat))
 
-		if _, err := io.Copy(origFile, res.Body); err != nil {
-			erro.Printf("%+v", err)
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		origFile.Close()
+		rc, err := cache.GetOrCreate(cachePath, func(tmpPath string) error {
+			fullURL := (&url.URL{
+				Scheme: originalURL.Scheme,
+				Host:   originalURL.Host,
+				Path:   urlQ,
+			}).String()
+
+			res, err := client.Get(fullURL)
+			if err != nil {
+				return err
+			}
+			defer res.Body.Close()
+
+			if res.StatusCode != http.StatusOK {
+				return fmt.Errorf("upstream returned %s", res.Status)
+			}
+
+			origPath := filepath.Join(cacheDir, filename+filepath.Ext(urlQ))
+			origFile, err := os.OpenFile(origPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+			defer origFile.Close()
+
+			if _, err := io.Copy(origFile, res.Body); err != nil {
+				return err
+			}
+			origFile.Close()
 
-		err = cache.set(webpPath, func() error {
 			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 			defer cancel()
-			if out, err := exec.CommandContext(ctx, "cwebp", "-quiet", "-q", quality, "-resize", width, height, origPath, "-o", webpPath).CombinedOutput(); err != nil {
-				return fmt.Errorf("failed to execute cwebp (%s): %w", out, err)
+
+			var etag string
+			switch outFormat {
+			case formatAVIF:
+				if err := encodeAVIF(ctx, origPath, tmpPath, width, height, quality); err != nil {
+					return err
+				}
+			case formatWebp:
+				widthI, _ := strconv.Atoi(width)
+				heightI, _ := strconv.Atoi(height)
+				qualityI, err := strconv.Atoi(quality)
+				if err != nil {
+					qualityI = 80
+				}
+
+				e, err := encoderBackend.EncodeWebp(ctx, origPath, tmpPath, widthI, heightI, qualityI)
+				if err != nil {
+					return err
+				}
+				etag = e
+			default:
+				e, err := copyFile(origPath, tmpPath)
+				if err != nil {
+					return err
+				}
+				etag = e
+			}
+
+			if etag == "" {
+				if e, err := hashFile(tmpPath); err == nil {
+					etag = e
+				}
+			}
+			if etag != "" {
+				if err := writeMeta(cachePath, etag, time.Now()); err != nil {
+					warn.Printf("%+v", err)
+				}
 			}
+
 			return nil
 		})
 		if err != nil {
+			if errors.Is(err, errNegativeCached) {
+				http.Error(rw, "upstream recently failed, not retrying yet", http.StatusBadGateway)
+				return
+			}
+
 			erro.Printf("%+v", err)
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		defer rc.Close()
 
-		webpFile, err := os.Open(webpPath)
-		if err != nil {
+		if err := serveFile(rw, r, rc.(*os.File), cachePath, contentType); err != nil {
 			erro.Printf("%+v", err)
 			http.Error(rw, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer webpFile.Close()
+	}
+}
 
+// metricsHandler exposes cache hit/miss/coalesced/error counters in
+// Prometheus text format.
+func metricsHandler(cache *store) func(rw http.ResponseWriter, r *http.Request) {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		m := cache.Metrics()
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
 
-		if  err := writeWebp(rw, webpFile); err != nil {
-			erro.Printf("%+v", err)
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
-			return
+		fmt.Fprintf(rw, "# HELP img_optimizer_cache_hits_total Cache hits.\n")
+		fmt.Fprintf(rw, "# TYPE img_optimizer_cache_hits_total counter\n")
+		fmt.Fprintf(rw, "img_optimizer_cache_hits_total %d\n", m.hits)
+
+		fmt.Fprintf(rw, "# HELP img_optimizer_cache_misses_total Cache misses.\n")
+		fmt.Fprintf(rw, "# TYPE img_optimizer_cache_misses_total counter\n")
+		fmt.Fprintf(rw, "img_optimizer_cache_misses_total %d\n", m.misses)
+
+		fmt.Fprintf(rw, "# HELP img_optimizer_cache_coalesced_total Requests coalesced onto an in-flight fetch.\n")
+		fmt.Fprintf(rw, "# TYPE img_optimizer_cache_coalesced_total counter\n")
+		fmt.Fprintf(rw, "img_optimizer_cache_coalesced_total %d\n", m.coalesced)
+
+		fmt.Fprintf(rw, "# HELP img_optimizer_cache_errors_total Fetch or encode errors.\n")
+		fmt.Fprintf(rw, "# TYPE img_optimizer_cache_errors_total counter\n")
+		fmt.Fprintf(rw, "img_optimizer_cache_errors_total %d\n", m.errors)
+	}
+}
+
+// encodeAVIF shells out to the `avifenc` binary, which (unlike cwebp) has no
+// resize flag of its own, so width/height are applied beforehand by decoding
+// and resizing the source into a temporary PNG and pointing avifenc at that
+// instead of srcPath.
+func encodeAVIF(ctx context.Context, srcPath, dstPath, width, height, quality string) error {
+	qualityI, err := strconv.Atoi(quality)
+	if err != nil {
+		qualityI = 80
+	}
+
+	widthI, _ := strconv.Atoi(width)
+	heightI, _ := strconv.Atoi(height)
+
+	in := srcPath
+	if widthI != 0 || heightI != 0 {
+		resizedPath := dstPath + ".resized.png"
+		if err := resizeToPNG(srcPath, resizedPath, widthI, heightI); err != nil {
+			return err
 		}
+		defer os.Remove(resizedPath)
+		in = resizedPath
 	}
+
+	if out, err := exec.CommandContext(ctx, "avifenc", "-q", strconv.Itoa(qualityI), in, dstPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to execute avifenc (%s): %w", out, err)
+	}
+	return nil
+}
+
+// resizeToPNG decodes srcPath, resizes it via the shared resize helper, and
+// writes the result to dstPath as a PNG that avifenc can read.
+func resizeToPNG(srcPath, dstPath string, width, height int) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %w", srcPath, err)
+	}
+
+	dst, err := os.OpenFile(dstPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	return png.Encode(dst, resize(img, width, height))
+}
+
+// copyFile streams srcPath to dstPath, returning the sha256 hex digest of
+// the bytes copied so callers don't have to re-read the file to compute it.
+func copyFile(srcPath, dstPath string) (string, error) {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(dstPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(dst, io.TeeReader(src, h)); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 func prepareCacheDir() error {
@@ -227,11 +466,29 @@ func prepareCacheDir() error {
 	return nil
 }
 
-func writeWebp(rw http.ResponseWriter, r io.Reader) error {
-	if _, err := io.Copy(rw, r); err != nil {
+// serveFile serves f through http.ServeContent so Range, If-None-Match and
+// If-Modified-Since are honored, setting Content-Type, Etag and Cache-Control
+// before the fact so ServeContent can fall back to a 304 when they match.
+func serveFile(rw http.ResponseWriter, r *http.Request, f *os.File, path, contentType string) error {
+	info, err := f.Stat()
+	if err != nil {
 		return err
 	}
 
-	rw.Header().Add("content-type", "image/webp")
+	etag, _, err := readMeta(path)
+	if err != nil || etag == "" {
+		if etag, err = hashFile(path); err != nil {
+			return err
+		}
+		if err := writeMeta(path, etag, time.Now()); err != nil {
+			warn.Printf("%+v", err)
+		}
+	}
+
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Etag", `"`+etag+`"`)
+	rw.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", clientMaxAge))
+
+	http.ServeContent(rw, r, filepath.Base(path), info.ModTime(), f)
 	return nil
 }
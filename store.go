@@ -1,31 +1,150 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	errKeyNotFound    = errors.New("key not found")
+	errNegativeCached = errors.New("key recently failed to populate, not retrying yet")
 )
 
-var errKeyNotFound = errors.New("key not found")
+const (
+	// cacheForever is the maxAge sentinel meaning entries never expire.
+	cacheForever = time.Duration(-1)
+	// cacheDisabled is the maxAge sentinel meaning entries expire immediately.
+	cacheDisabled = time.Duration(0)
+
+	janitorInterval = time.Minute
+
+	metaSuffix = ".meta"
+	tmpSuffix  = ".tmp"
+)
+
+type cacheConfig struct {
+	dir         string
+	maxAge      time.Duration
+	maxItems    int
+	negativeTTL time.Duration
+}
+
+type cacheEntry struct {
+	size  int64
+	atime time.Time
+}
+
+type cacheMetrics struct {
+	hits      int64
+	misses    int64
+	coalesced int64
+	errors    int64
+}
 
 type (
 	store struct {
-		m   sync.Map
+		dir         string
+		maxAge      time.Duration
+		maxItems    int
+		negativeTTL time.Duration
+
+		mu    sync.Mutex
+		index map[string]*cacheEntry
+
+		locks sync.Map
+		sf    singleflight.Group
+
+		negative sync.Map // key -> time.Time (retry-after)
+
+		metrics cacheMetrics
 	}
 )
 
 func newStore(dir string) *store {
-	return &store{}
+	return newStoreWithConfig(cacheConfig{dir: dir, maxAge: cacheForever, maxItems: cacheSize})
+}
+
+func newStoreWithConfig(cfg cacheConfig) *store {
+	fc := &store{
+		dir:         cfg.dir,
+		maxAge:      cfg.maxAge,
+		maxItems:    cfg.maxItems,
+		negativeTTL: cfg.negativeTTL,
+		index:       map[string]*cacheEntry{},
+	}
+
+	fc.scan()
+	go fc.janitor()
+
+	return fc
+}
+
+// scan builds the (path, size, atime) index of an existing cache dir on
+// startup, taking atime from the sidecar and falling back to the file's
+// mtime, so LRU and maxAge decisions survive restarts.
+func (fc *store) scan() {
+	filepath.Walk(fc.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) == metaSuffix || filepath.Ext(path) == tmpSuffix {
+			return nil
+		}
+
+		atime := info.ModTime()
+		if _, metaAtime, err := readMeta(path); err == nil && !metaAtime.IsZero() {
+			atime = metaAtime
+		}
+
+		fc.mu.Lock()
+		fc.index[path] = &cacheEntry{size: info.Size(), atime: atime}
+		fc.mu.Unlock()
+
+		return nil
+	})
 }
 
+func (fc *store) lockFor(path string) *sync.RWMutex {
+	v, _ := fc.locks.LoadOrStore(path, &sync.RWMutex{})
+	return v.(*sync.RWMutex)
+}
+
+// get returns path's content if it's cached and not expired.
 func (fc *store) get(path string) (io.ReadCloser, error) {
-	v, _ := fc.m.LoadOrStore(path, &sync.RWMutex{})
-	m := v.(*sync.RWMutex)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errKeyNotFound
+	}
+
+	if fc.expired(info) {
+		return nil, errKeyNotFound
+	}
+
+	return fc.open(path)
+}
+
+// open returns path's content unconditionally, without an expiry check. It
+// takes a read lock so it never observes a half-written file: a concurrent
+// GetOrCreate for the same path holds the write lock until its rename
+// lands. Used both by get (once it's confirmed the entry is fresh) and by
+// GetOrCreate to hand back content it just created, which is fresh by
+// definition even under -cache-max-age 0.
+func (fc *store) open(path string) (io.ReadCloser, error) {
+	m := fc.lockFor(path)
 	m.RLock()
 	defer m.RUnlock()
 
-	if _, err := os.Stat(path); err != nil {
+	info, err := os.Stat(path)
+	if err != nil {
 		return nil, errKeyNotFound
 	}
 
@@ -34,14 +153,212 @@ func (fc *store) get(path string) (io.ReadCloser, error) {
 		return nil, errKeyNotFound
 	}
 
+	now := time.Now()
+	touchMetaAtime(path, now)
+	fc.touch(path, info.Size(), now)
+
 	return f, nil
 }
 
-func (fc *store) set(key string, f func() error) error {
-	v, _ := fc.m.LoadOrStore(key, &sync.RWMutex{})
-	m := v.(*sync.RWMutex)
-	m.RLock()
-	defer m.RUnlock()
+// GetOrCreate returns path's cached content, populating it first if
+// missing. Concurrent callers for the same path are coalesced onto a
+// single invocation of create via singleflight, and the write lock taken
+// around the rename keeps get() from ever seeing a partial file.
+//
+// create must write its output to tmpPath; GetOrCreate renames it into
+// place atomically on success.
+func (fc *store) GetOrCreate(path string, create func(tmpPath string) error) (io.ReadCloser, error) {
+	if f, err := fc.get(path); err == nil {
+		atomic.AddInt64(&fc.metrics.hits, 1)
+		return f, nil
+	}
+	atomic.AddInt64(&fc.metrics.misses, 1)
+
+	if until, ok := fc.negative.Load(path); ok {
+		if time.Now().Before(until.(time.Time)) {
+			return nil, errNegativeCached
+		}
+		fc.negative.Delete(path)
+	}
+
+	_, err, shared := fc.sf.Do(path, func() (interface{}, error) {
+		if info, err := os.Stat(path); err == nil && !fc.expired(info) {
+			return nil, nil
+		}
 
-	return f()
+		tmpPath := path + tmpSuffix
+		if err := create(tmpPath); err != nil {
+			os.Remove(tmpPath)
+			if fc.negativeTTL > 0 {
+				fc.negative.Store(path, time.Now().Add(fc.negativeTTL))
+			}
+			return nil, err
+		}
+
+		m := fc.lockFor(path)
+		m.Lock()
+		err := os.Rename(tmpPath, path)
+		m.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		if info, err := os.Stat(path); err == nil {
+			fc.touch(path, info.Size(), time.Now())
+		}
+
+		return nil, nil
+	})
+	if shared {
+		atomic.AddInt64(&fc.metrics.coalesced, 1)
+	}
+	if err != nil {
+		atomic.AddInt64(&fc.metrics.errors, 1)
+		return nil, err
+	}
+
+	// The content at path was just (re)created above, so it's fresh by
+	// definition -- go straight to open instead of get, which would
+	// otherwise immediately call it expired under -cache-max-age 0.
+	return fc.open(path)
+}
+
+// Metrics returns a point-in-time snapshot for the /metrics endpoint.
+func (fc *store) Metrics() cacheMetrics {
+	return cacheMetrics{
+		hits:      atomic.LoadInt64(&fc.metrics.hits),
+		misses:    atomic.LoadInt64(&fc.metrics.misses),
+		coalesced: atomic.LoadInt64(&fc.metrics.coalesced),
+		errors:    atomic.LoadInt64(&fc.metrics.errors),
+	}
+}
+
+func (fc *store) expired(info os.FileInfo) bool {
+	switch fc.maxAge {
+	case cacheForever:
+		return false
+	case cacheDisabled:
+		return true
+	default:
+		return time.Since(info.ModTime()) > fc.maxAge
+	}
+}
+
+func (fc *store) touch(path string, size int64, atime time.Time) {
+	fc.mu.Lock()
+	fc.index[path] = &cacheEntry{size: size, atime: atime}
+	fc.mu.Unlock()
+}
+
+// janitor evicts entries older than maxAge and trims the least-recently-used
+// entries until the cache is back under maxItems.
+func (fc *store) janitor() {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		fc.evictExpired()
+		fc.pruneLRU()
+	}
+}
+
+func (fc *store) evictExpired() {
+	if fc.maxAge == cacheForever {
+		return
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	for path, e := range fc.index {
+		if fc.maxAge == cacheDisabled || time.Since(e.atime) > fc.maxAge {
+			if err := os.Remove(path); err == nil || os.IsNotExist(err) {
+				delete(fc.index, path)
+				os.Remove(path + metaSuffix)
+			}
+		}
+	}
+}
+
+func (fc *store) pruneLRU() {
+	if fc.maxItems <= 0 {
+		return
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if len(fc.index) <= fc.maxItems {
+		return
+	}
+
+	paths := make([]string, 0, len(fc.index))
+	for path := range fc.index {
+		paths = append(paths, path)
+	}
+
+	sort.Slice(paths, func(i, j int) bool {
+		return fc.index[paths[i]].atime.Before(fc.index[paths[j]].atime)
+	})
+
+	for _, path := range paths[:len(paths)-fc.maxItems] {
+		if err := os.Remove(path); err == nil || os.IsNotExist(err) {
+			delete(fc.index, path)
+			os.Remove(path + metaSuffix)
+		}
+	}
+}
+
+// hashFile returns the sha256 hex digest of path's contents, used as an
+// ETag for entries that weren't hashed inline while being written (e.g.
+// encoded by an external `cwebp`/`avifenc` subprocess).
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeMeta persists a cache entry's ETag and LRU access time in a sidecar
+// file, so both survive restarts without re-hashing the content or reusing
+// its mtime. Keeping atime out of the content file itself means reads never
+// need to touch the mtime that serveFile hands to http.ServeContent as
+// Last-Modified.
+func writeMeta(path, etag string, atime time.Time) error {
+	b := []byte(etag + "\n" + strconv.FormatInt(atime.UnixNano(), 10))
+	return os.WriteFile(path+metaSuffix, b, 0644)
+}
+
+// readMeta reads back the ETag and atime written by writeMeta. atime is the
+// zero Time if the sidecar predates atime tracking.
+func readMeta(path string) (etag string, atime time.Time, err error) {
+	b, err := os.ReadFile(path + metaSuffix)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	etag, rest, _ := strings.Cut(string(b), "\n")
+	if ns, err := strconv.ParseInt(rest, 10, 64); err == nil {
+		atime = time.Unix(0, ns)
+	}
+
+	return etag, atime, nil
+}
+
+// touchMetaAtime updates just the atime half of path's sidecar, preserving
+// its ETag. It's best-effort: a failure just means scan() falls back to the
+// content file's mtime on next restart.
+func touchMetaAtime(path string, atime time.Time) {
+	etag, _, _ := readMeta(path)
+	if err := writeMeta(path, etag, atime); err != nil {
+		warn.Printf("%+v", err)
+	}
 }
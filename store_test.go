@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestStoreGetOrCreateCoalescesConcurrentCreates exercises the singleflight
+// path: many concurrent callers for the same key should observe exactly one
+// call to create, and every caller should get back the full content once
+// it's done -- never a partial file from the lock window around the rename.
+func TestStoreGetOrCreateCoalescesConcurrentCreates(t *testing.T) {
+	fc := newStoreWithConfig(cacheConfig{dir: t.TempDir(), maxAge: cacheForever})
+	path := filepath.Join(fc.dir, "key")
+
+	const want = "the quick brown fox"
+	var calls int32
+
+	const n = 50
+	var wg sync.WaitGroup
+	results := make([]string, n)
+	errs := make([]error, n)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rc, err := fc.GetOrCreate(path, func(tmpPath string) error {
+				atomic.AddInt32(&calls, 1)
+				return os.WriteFile(tmpPath, []byte(want), 0644)
+			})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer rc.Close()
+			b, err := io.ReadAll(rc)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			results[i] = string(b)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("caller %d: %v", i, err)
+		}
+		if results[i] != want {
+			t.Fatalf("caller %d: got %q, want %q", i, results[i], want)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("create called %d times, want exactly 1 (singleflight should coalesce)", calls)
+	}
+
+	if got := fc.Metrics().coalesced; got == 0 {
+		t.Errorf("expected coalesced hits to be counted, got 0")
+	}
+}
+
+// TestStoreGetOrCreatePropagatesCreateError ensures a failing create doesn't
+// poison the cache with a partial file, and that the key can be retried.
+func TestStoreGetOrCreatePropagatesCreateError(t *testing.T) {
+	fc := newStoreWithConfig(cacheConfig{dir: t.TempDir(), maxAge: cacheForever})
+	path := filepath.Join(fc.dir, "key")
+
+	wantErr := errKeyNotFound // any sentinel works here, just needs to round-trip
+	_, err := fc.GetOrCreate(path, func(tmpPath string) error {
+		return wantErr
+	})
+	if err != wantErr {
+		t.Fatalf("got err %v, want %v", err, wantErr)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected no file left behind after a failed create, stat err = %v", err)
+	}
+
+	rc, err := fc.GetOrCreate(path, func(tmpPath string) error {
+		return os.WriteFile(tmpPath, []byte("ok"), 0644)
+	})
+	if err != nil {
+		t.Fatalf("retry after failure: %v", err)
+	}
+	rc.Close()
+}
+
+// TestStoreGetOrCreateWithCacheDisabled covers -cache-max-age 0: every call
+// must still get back the content it just created, and a later call must
+// re-invoke create rather than serving the previous, already-expired file.
+func TestStoreGetOrCreateWithCacheDisabled(t *testing.T) {
+	fc := newStoreWithConfig(cacheConfig{dir: t.TempDir(), maxAge: cacheDisabled})
+	path := filepath.Join(fc.dir, "key")
+
+	rc, err := fc.GetOrCreate(path, func(tmpPath string) error {
+		return os.WriteFile(tmpPath, []byte("first"), 0644)
+	})
+	if err != nil {
+		t.Fatalf("first GetOrCreate: %v", err)
+	}
+	b, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("reading first result: %v", err)
+	}
+	if string(b) != "first" {
+		t.Fatalf("got %q, want %q", b, "first")
+	}
+
+	var secondCalled bool
+	rc, err = fc.GetOrCreate(path, func(tmpPath string) error {
+		secondCalled = true
+		return os.WriteFile(tmpPath, []byte("second"), 0644)
+	})
+	if err != nil {
+		t.Fatalf("second GetOrCreate: %v", err)
+	}
+	b, err = io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("reading second result: %v", err)
+	}
+	if !secondCalled {
+		t.Fatal("expected create to be invoked again with the cache disabled")
+	}
+	if string(b) != "second" {
+		t.Fatalf("got %q, want %q", b, "second")
+	}
+}